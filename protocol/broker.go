@@ -15,9 +15,15 @@ package protocol
 import enc "sarama/encoding"
 import "sarama/types"
 import (
+	"context"
+	"crypto/tls"
 	"io"
 	"net"
 	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"golang.org/x/time/rate"
 )
 
 // Broker represents a single Kafka broker connection. All operations on this object are entirely concurrency-safe.
@@ -25,6 +31,7 @@ type Broker struct {
 	id   int32
 	host string
 	port int32
+	conf *BrokerConfig
 
 	correlation_id int32
 	conn           net.Conn
@@ -32,6 +39,23 @@ type Broker struct {
 
 	responses chan responsePromise
 	done      chan bool
+
+	// connLost is this generation's dead-connection signal; see Connect's assignment for details.
+	connLost chan struct{}
+
+	requestLimiter *rate.Limiter
+	byteLimiter    *rate.Limiter
+
+	abandoned abandonedSet
+
+	// StateChanged, if set before Connect is called, receives Disconnected/Reconnecting/
+	// Connected transitions. Sends are non-blocking: a full or unread channel drops states
+	// rather than stalling the reconnect loop.
+	StateChanged chan BrokerState
+
+	// stopReconnect is closed by Close to cancel any reconnectLoop started against this
+	// connection generation; it is recreated on every successful Connect.
+	stopReconnect chan struct{}
 }
 
 type responsePromise struct {
@@ -40,16 +64,27 @@ type responsePromise struct {
 	errors         chan error
 }
 
-// NewBroker creates and returns a Broker targetting the given host:port address.
-// This does not attempt to actually connect, you have to call Connect() for that.
-func NewBroker(host string, port int32) *Broker {
+// NewBroker creates and returns a Broker targetting the given host:port address. conf may be nil,
+// in which case the broker dials a plain, unauthenticated TCP connection exactly as before; pass a
+// *BrokerConfig to enable TLS and/or SASL. This does not attempt to actually connect, you have to
+// call Connect() for that.
+func NewBroker(host string, port int32, conf *BrokerConfig) *Broker {
+	if conf == nil {
+		conf = NewBrokerConfig()
+	}
+
 	b := new(Broker)
 	b.id = -1 // don't know it yet
 	b.host = host
 	b.port = port
+	b.conf = conf
 	return b
 }
 
+// Connect dials the broker. On a redial (whether triggered manually or by the AutoReconnect
+// loop), correlation_id is reset to zero: the server does not remember the correlation IDs a
+// previous connection used, so continuing to count up from wherever the old connection left off
+// would just make the first few IDs of a new connection harder to read in logs, not more correct.
 func (b *Broker) Connect() error {
 	b.lock.Lock()
 	defer b.lock.Unlock()
@@ -58,42 +93,108 @@ func (b *Broker) Connect() error {
 		return AlreadyConnected
 	}
 
+	b.correlation_id = 0
+
+	// Defended here, not just in NewBrokerConfig: a caller building a BrokerConfig as a struct
+	// literal (the natural way, since it has no setters) gets the zero value for any field they
+	// don't set, and a zero MaxInFlightRequests is not a usable "off" setting - it's an unbuffered
+	// request queue that makes every promiseResponse send block until a concurrent one completes.
+	if b.conf.MaxInFlightRequests <= 0 {
+		b.conf.MaxInFlightRequests = 4
+	}
+
+	// Same reasoning as MaxInFlightRequests above: a zero ReconnectMinInterval/ReconnectMaxInterval
+	// from a struct-literal BrokerConfig isn't "reconnect instantly", it's reconnectLoop busy-looping
+	// against a dead broker with no backoff at all.
+	if b.conf.ReconnectMinInterval <= 0 {
+		b.conf.ReconnectMinInterval = 250 * time.Millisecond
+	}
+	if b.conf.ReconnectMaxInterval <= 0 {
+		b.conf.ReconnectMaxInterval = 30 * time.Second
+	}
+
 	addr, err := net.ResolveIPAddr("ip", b.host)
 	if err != nil {
 		return err
 	}
 
-	b.conn, err = net.DialTCP("tcp", nil, &net.TCPAddr{IP: addr.IP, Port: int(b.port), Zone: addr.Zone})
+	dialed, err := net.DialTCP("tcp", nil, &net.TCPAddr{IP: addr.IP, Port: int(b.port), Zone: addr.Zone})
 	if err != nil {
 		return err
 	}
 
+	if b.conf.TLS != nil {
+		b.conn = tls.Client(dialed, b.conf.TLS)
+	} else {
+		b.conn = dialed
+	}
+
+	if b.conf.SASL != nil {
+		if err = b.authenticateSASL(b.conf.SASL); err != nil {
+			b.conn.Close()
+			b.conn = nil
+			return err
+		}
+	}
+
 	b.done = make(chan bool)
 
-	// permit a few outstanding requests before we block waiting for responses
-	b.responses = make(chan responsePromise, 4)
+	// permit MaxInFlightRequests outstanding requests before send blocks waiting for responses
+	b.responses = make(chan responsePromise, b.conf.MaxInFlightRequests)
+
+	// connLost is closed exactly once, by loseConnection, when this generation's connection dies;
+	// send uses it to notice a stale b.responses reference instead of blocking on it forever.
+	b.connLost = make(chan struct{})
+
+	// correlation IDs are reused across generations (they reset to 0 above), so an abandoned-set
+	// entry from a previous connection must not survive into this one.
+	b.abandoned = abandonedSet{}
+
+	b.requestLimiter, b.byteLimiter = newLimiters(b.conf)
+	b.stopReconnect = make(chan struct{})
 
 	go b.responseReceiver()
 
 	return nil
 }
 
+// Close shuts the broker down: it stops any in-progress or future AutoReconnect redial, then (if
+// currently connected) closes b.responses so responseReceiver drains and exits, and waits for it
+// to do so. The wait on b.done deliberately happens without holding b.lock - responseReceiver's
+// own exit path may call loseConnection, which needs the lock to tear the connection down, and
+// holding it here while blocked on b.done would deadlock against that.
 func (b *Broker) Close() error {
 	b.lock.Lock()
-	defer b.lock.Unlock()
+
+	if b.stopReconnect != nil {
+		close(b.stopReconnect)
+		b.stopReconnect = nil
+	}
 
 	if b.conn == nil {
+		b.lock.Unlock()
 		return NotConnected
 	}
 
+	conn := b.conn
+	done := b.done
 	close(b.responses)
-	<-b.done
+	b.lock.Unlock()
 
-	err := b.conn.Close()
+	<-done
 
-	b.conn = nil
-	b.done = nil
-	b.responses = nil
+	b.lock.Lock()
+	var err error
+	// b.conn may already have been replaced (nil, or a fresh redial) by a concurrent
+	// loseConnection/Connect by the time responseReceiver finished; only close the connection we
+	// actually observed above, and only if nothing else has since taken ownership of it.
+	if b.conn == conn {
+		err = conn.Close()
+		b.conn = nil
+		b.done = nil
+		b.responses = nil
+	}
+	b.lock.Unlock()
 
 	return err
 }
@@ -116,9 +217,13 @@ func (b *Broker) Equals(a *Broker) bool {
 }
 
 func (b *Broker) GetMetadata(clientID string, request *MetadataRequest) (*MetadataResponse, error) {
+	return b.GetMetadataCtx(context.Background(), clientID, request)
+}
+
+func (b *Broker) GetMetadataCtx(ctx context.Context, clientID string, request *MetadataRequest) (*MetadataResponse, error) {
 	response := new(MetadataResponse)
 
-	err := b.sendAndReceive(clientID, request, response)
+	err := b.sendAndReceiveCtx(ctx, "GetMetadata", clientID, request, response)
 
 	if err != nil {
 		return nil, err
@@ -128,9 +233,13 @@ func (b *Broker) GetMetadata(clientID string, request *MetadataRequest) (*Metada
 }
 
 func (b *Broker) GetAvailableOffsets(clientID string, request *OffsetRequest) (*OffsetResponse, error) {
+	return b.GetAvailableOffsetsCtx(context.Background(), clientID, request)
+}
+
+func (b *Broker) GetAvailableOffsetsCtx(ctx context.Context, clientID string, request *OffsetRequest) (*OffsetResponse, error) {
 	response := new(OffsetResponse)
 
-	err := b.sendAndReceive(clientID, request, response)
+	err := b.sendAndReceiveCtx(ctx, "GetAvailableOffsets", clientID, request, response)
 
 	if err != nil {
 		return nil, err
@@ -140,14 +249,18 @@ func (b *Broker) GetAvailableOffsets(clientID string, request *OffsetRequest) (*
 }
 
 func (b *Broker) Produce(clientID string, request *ProduceRequest) (*ProduceResponse, error) {
+	return b.ProduceCtx(context.Background(), clientID, request)
+}
+
+func (b *Broker) ProduceCtx(ctx context.Context, clientID string, request *ProduceRequest) (*ProduceResponse, error) {
 	var response *ProduceResponse
 	var err error
 
 	if request.RequiredAcks == types.NO_RESPONSE {
-		err = b.sendAndReceive(clientID, request, nil)
+		err = b.sendAndReceiveCtx(ctx, "Produce", clientID, request, nil)
 	} else {
 		response = new(ProduceResponse)
-		err = b.sendAndReceive(clientID, request, response)
+		err = b.sendAndReceiveCtx(ctx, "Produce", clientID, request, response)
 	}
 
 	if err != nil {
@@ -158,9 +271,13 @@ func (b *Broker) Produce(clientID string, request *ProduceRequest) (*ProduceResp
 }
 
 func (b *Broker) Fetch(clientID string, request *FetchRequest) (*FetchResponse, error) {
+	return b.FetchCtx(context.Background(), clientID, request)
+}
+
+func (b *Broker) FetchCtx(ctx context.Context, clientID string, request *FetchRequest) (*FetchResponse, error) {
 	response := new(FetchResponse)
 
-	err := b.sendAndReceive(clientID, request, response)
+	err := b.sendAndReceiveCtx(ctx, "Fetch", clientID, request, response)
 
 	if err != nil {
 		return nil, err
@@ -170,9 +287,13 @@ func (b *Broker) Fetch(clientID string, request *FetchRequest) (*FetchResponse,
 }
 
 func (b *Broker) CommitOffset(clientID string, request *OffsetCommitRequest) (*OffsetCommitResponse, error) {
+	return b.CommitOffsetCtx(context.Background(), clientID, request)
+}
+
+func (b *Broker) CommitOffsetCtx(ctx context.Context, clientID string, request *OffsetCommitRequest) (*OffsetCommitResponse, error) {
 	response := new(OffsetCommitResponse)
 
-	err := b.sendAndReceive(clientID, request, response)
+	err := b.sendAndReceiveCtx(ctx, "CommitOffset", clientID, request, response)
 
 	if err != nil {
 		return nil, err
@@ -182,9 +303,13 @@ func (b *Broker) CommitOffset(clientID string, request *OffsetCommitRequest) (*O
 }
 
 func (b *Broker) FetchOffset(clientID string, request *OffsetFetchRequest) (*OffsetFetchResponse, error) {
+	return b.FetchOffsetCtx(context.Background(), clientID, request)
+}
+
+func (b *Broker) FetchOffsetCtx(ctx context.Context, clientID string, request *OffsetFetchRequest) (*OffsetFetchResponse, error) {
 	response := new(OffsetFetchResponse)
 
-	err := b.sendAndReceive(clientID, request, response)
+	err := b.sendAndReceiveCtx(ctx, "FetchOffset", clientID, request, response)
 
 	if err != nil {
 		return nil, err
@@ -193,43 +318,147 @@ func (b *Broker) FetchOffset(clientID string, request *OffsetFetchRequest) (*Off
 	return response, nil
 }
 
-func (b *Broker) send(clientID string, req requestEncoder, promiseResponse bool) (*responsePromise, error) {
+// send encodes and writes req, then (for requests expecting a response) enqueues a
+// responsePromise for responseReceiver to fill in. The broker lock is only held for encoding and
+// writing plus one non-blocking enqueue attempt; once MaxInFlightRequests are already outstanding, the enqueue
+// itself happens lock-free so a full window backpressures the caller, not every other goroutine
+// using the broker. With a cancelable ctx, a full window blocks until a slot frees or ctx is
+// done; with a non-cancelable one (eg. context.Background()) it fails fast with
+// ErrBrokerOverloaded instead of blocking forever.
+// send encodes and writes req, returning the size of the encoded request in bytes alongside the
+// usual promise/error so callers can report it (eg. to Metrics.RecordRequest) without re-encoding
+// or racing b.correlation_id themselves.
+func (b *Broker) send(ctx context.Context, clientID string, req requestEncoder, promiseResponse bool) (*responsePromise, int, error) {
+	if b.requestLimiter != nil && !b.requestLimiter.Allow() {
+		return nil, 0, ErrRateLimited
+	}
+
 	b.lock.Lock()
-	defer b.lock.Unlock()
 
 	if b.conn == nil {
-		return nil, NotConnected
+		b.lock.Unlock()
+		return nil, 0, NotConnected
 	}
 
 	fullRequest := request{b.correlation_id, clientID, req}
 	buf, err := enc.Encode(&fullRequest)
 	if err != nil {
-		return nil, err
+		b.lock.Unlock()
+		return nil, 0, err
 	}
 
-	_, err = b.conn.Write(buf)
-	if err != nil {
-		return nil, err
+	if b.byteLimiter != nil && !b.byteLimiter.AllowN(time.Now(), len(buf)) {
+		b.lock.Unlock()
+		return nil, 0, ErrRateLimited
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		b.conn.SetWriteDeadline(deadline)
+	} else {
+		b.conn.SetWriteDeadline(time.Time{})
+	}
+
+	if _, err = b.conn.Write(buf); err != nil {
+		b.lock.Unlock()
+		return nil, len(buf), err
 	}
 	b.correlation_id++
 
 	if !promiseResponse {
-		return nil, nil
+		b.lock.Unlock()
+		return nil, len(buf), nil
 	}
 
 	promise := responsePromise{fullRequest.correlation_id, make(chan []byte), make(chan error)}
-	b.responses <- promise
 
-	return &promise, nil
+	// Tried while b.lock is still held: this is the same lock loseConnection takes to swap
+	// b.responses to nil, so there is no window in which we could enqueue into a channel
+	// loseConnection has already given up on and drained.
+	select {
+	case b.responses <- promise:
+		if b.conf.Metrics != nil {
+			b.conf.Metrics.RecordInFlight(len(b.responses))
+		}
+		b.lock.Unlock()
+		return &promise, len(buf), nil
+	default:
+	}
+
+	responses, connLost := b.responses, b.connLost
+	b.lock.Unlock()
+
+	if ctx.Done() == nil {
+		return nil, len(buf), ErrBrokerOverloaded
+	}
+
+	select {
+	case responses <- promise:
+	case <-connLost:
+		// This generation's connection died while we were waiting for a slot; responses is the
+		// channel loseConnection already abandoned, so waiting on it further would hang forever.
+		return nil, len(buf), ErrConnectionLost
+	case <-ctx.Done():
+		return nil, len(buf), ctx.Err()
+	}
+
+	if b.conf.Metrics != nil {
+		b.conf.Metrics.RecordInFlight(len(responses))
+	}
+
+	return &promise, len(buf), nil
 }
 
 func (b *Broker) sendAndReceive(clientID string, req requestEncoder, res enc.Decoder) error {
-	promise, err := b.send(clientID, req, res != nil)
+	return b.sendAndReceiveCtx(context.Background(), "", clientID, req, res)
+}
 
-	if err != nil {
-		return err
+// apiKeyer is implemented by every requestEncoder so sendAndReceiveCtx can tag spans/metrics with
+// the Kafka API key without a type switch over every request type.
+type apiKeyer interface {
+	key() int16
+}
+
+// sendAndReceiveCtx is the instrumented core that every Broker method (and their Ctx variants)
+// funnels through. Tracing is entirely skipped, not just unsampled, when b.conf.Tracing is false,
+// so the opentracing machinery allocates nothing on the hot path for callers who don't use it.
+func (b *Broker) sendAndReceiveCtx(ctx context.Context, operation, clientID string, req requestEncoder, res enc.Decoder) error {
+	var apiKey int16
+	if keyer, ok := req.(apiKeyer); ok {
+		apiKey = keyer.key()
 	}
 
+	var span opentracing.Span
+	if b.conf.Tracing && operation != "" {
+		span = b.startBrokerSpan(ctx, operation, apiKey)
+	}
+
+	start := time.Now()
+	promise, bytes, err := b.send(ctx, clientID, req, res != nil)
+
+	// The correlation id tagged on the span/used for abandonment must be the one send() actually
+	// assigned to this request, not a peek at b.correlation_id - another goroutine's send() may
+	// already have incremented it by the time we'd read it here.
+	// Without a promise (no response expected, or send failed) there is no ID to report, so the
+	// span is left untagged rather than tagged with a misleading zero.
+	if promise != nil {
+		tagBrokerSpanCorrelationID(span, promise.correlation_id)
+	}
+
+	if err == nil {
+		err = b.waitForResponse(ctx, promise, res)
+	}
+
+	if b.conf.Metrics != nil {
+		b.conf.Metrics.RecordRequest(apiKey, bytes, time.Since(start), err)
+	}
+	finishBrokerSpan(span, err)
+
+	return err
+}
+
+// waitForResponse blocks for the reply to a request send() has already written, or until ctx is
+// done. promise is nil for requests that don't expect a response (eg. Produce with NO_RESPONSE).
+func (b *Broker) waitForResponse(ctx context.Context, promise *responsePromise, res enc.Decoder) error {
 	if promise == nil {
 		return nil
 	}
@@ -237,8 +466,13 @@ func (b *Broker) sendAndReceive(clientID string, req requestEncoder, res enc.Dec
 	select {
 	case buf := <-promise.packets:
 		return enc.Decode(buf, res)
-	case err = <-promise.errors:
+	case err := <-promise.errors:
 		return err
+	case <-ctx.Done():
+		// responseReceiver still owes this correlation ID a reply; mark it abandoned so it
+		// drops the reply on arrival instead of blocking forever on these unbuffered channels.
+		b.abandoned.add(promise.correlation_id)
+		return ctx.Err()
 	}
 }
 
@@ -262,33 +496,52 @@ func (b *Broker) Decode(pd enc.PacketDecoder) (err error) {
 }
 
 func (b *Broker) responseReceiver() {
+	// Every exit path below (connection lost or Close()'s channel close) must close b.done
+	// exactly once, since Close() waits on it without holding b.lock for the duration; a defer
+	// here keeps that true regardless of which return statement fires.
+	defer close(b.done)
+
 	header := make([]byte, 8)
 	for response := range b.responses {
 		_, err := io.ReadFull(b.conn, header)
 		if err != nil {
-			response.errors <- err
-			continue
+			if !b.abandoned.take(response.correlation_id) {
+				response.errors <- ErrConnectionLost
+			}
+			b.loseConnection()
+			return
 		}
 
 		decodedHeader := responseHeader{}
 		err = enc.Decode(header, &decodedHeader)
 		if err != nil {
-			response.errors <- err
+			if !b.abandoned.take(response.correlation_id) {
+				response.errors <- err
+			}
 			continue
 		}
 		if decodedHeader.correlation_id != response.correlation_id {
-			response.errors <- enc.DecodingError
+			if !b.abandoned.take(response.correlation_id) {
+				response.errors <- enc.DecodingError
+			}
 			continue
 		}
 
 		buf := make([]byte, decodedHeader.length-4)
 		_, err = io.ReadFull(b.conn, buf)
 		if err != nil {
-			response.errors <- err
-			continue
+			if !b.abandoned.take(response.correlation_id) {
+				response.errors <- ErrConnectionLost
+			}
+			b.loseConnection()
+			return
 		}
 
-		response.packets <- buf
+		// response.packets and response.errors are unbuffered and read at most once by the
+		// original caller; if that caller's ctx was cancelled it has already stopped
+		// listening, so the reply is simply dropped instead of blocking this goroutine forever.
+		if !b.abandoned.take(response.correlation_id) {
+			response.packets <- buf
+		}
 	}
-	close(b.done)
 }
@@ -0,0 +1,135 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/golang/snappy"
+	"github.com/pierrec/lz4"
+)
+
+// CompressionCodec identifies the compression algorithm applied to a message's value, as carried
+// in the low 3 bits of the message attributes byte.
+type CompressionCodec int8
+
+const (
+	CompressionNone   CompressionCodec = 0
+	CompressionGZIP   CompressionCodec = 1
+	CompressionSnappy CompressionCodec = 2
+	CompressionLZ4    CompressionCodec = 3
+)
+
+// xerialHeader is the fixed 8-byte magic + version/compat prefix that the xerial snappy framing
+// used by Kafka (and most client libraries) puts ahead of its length-prefixed chunk stream. Plain
+// snappy.Encode/Decode do not understand this framing, so it is implemented explicitly below.
+var xerialHeader = []byte{0x82, 'S', 'N', 'A', 'P', 'P', 'Y', 0}
+
+const (
+	xerialVersion           = 1
+	xerialCompatibleVersion = 1
+)
+
+// compress returns value compressed with codec, or value unchanged for CompressionNone.
+func compress(codec CompressionCodec, value []byte) ([]byte, error) {
+	switch codec {
+	case CompressionNone:
+		return value, nil
+	case CompressionGZIP:
+		var buf bytes.Buffer
+		writer := gzip.NewWriter(&buf)
+		if _, err := writer.Write(value); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressionSnappy:
+		return xerialEncode(value), nil
+	case CompressionLZ4:
+		var buf bytes.Buffer
+		writer := lz4.NewWriter(&buf)
+		if _, err := writer.Write(value); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("protocol: unsupported compression codec %d", codec)
+	}
+}
+
+// decompress reverses compress.
+func decompress(codec CompressionCodec, value []byte) ([]byte, error) {
+	switch codec {
+	case CompressionNone:
+		return value, nil
+	case CompressionGZIP:
+		reader, err := gzip.NewReader(bytes.NewReader(value))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return ioutil.ReadAll(reader)
+	case CompressionSnappy:
+		return xerialDecode(value)
+	case CompressionLZ4:
+		return ioutil.ReadAll(lz4.NewReader(bytes.NewReader(value)))
+	default:
+		return nil, fmt.Errorf("protocol: unsupported compression codec %d", codec)
+	}
+}
+
+// xerialEncode frames payload as a single-chunk xerial snappy stream: the 8-byte magic header,
+// the version/compat-version pair, then one length-prefixed block of plain snappy-compressed
+// bytes. Kafka brokers and most client libraries only understand this framing, not raw snappy.
+func xerialEncode(payload []byte) []byte {
+	block := snappy.Encode(nil, payload)
+
+	buf := make([]byte, 0, len(xerialHeader)+8+4+len(block))
+	buf = append(buf, xerialHeader...)
+	buf = appendInt32(buf, xerialVersion)
+	buf = appendInt32(buf, xerialCompatibleVersion)
+	buf = appendInt32(buf, int32(len(block)))
+	buf = append(buf, block...)
+	return buf
+}
+
+// xerialDecode reverses xerialEncode, concatenating every chunk in the stream (Kafka producers in
+// the wild sometimes emit more than one).
+func xerialDecode(data []byte) ([]byte, error) {
+	if len(data) < len(xerialHeader)+8 || !bytes.Equal(data[:len(xerialHeader)], xerialHeader) {
+		return nil, fmt.Errorf("protocol: not a valid xerial-framed snappy block")
+	}
+	data = data[len(xerialHeader)+8:] // skip magic + version + compat-version
+
+	var out bytes.Buffer
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("protocol: truncated xerial snappy chunk length")
+		}
+		chunkLen := int(int32(binary.BigEndian.Uint32(data[:4])))
+		data = data[4:]
+		if chunkLen < 0 || chunkLen > len(data) {
+			return nil, fmt.Errorf("protocol: truncated xerial snappy chunk body")
+		}
+		chunk, err := snappy.Decode(nil, data[:chunkLen])
+		if err != nil {
+			return nil, err
+		}
+		out.Write(chunk)
+		data = data[chunkLen:]
+	}
+	return out.Bytes(), nil
+}
+
+func appendInt32(buf []byte, v int32) []byte {
+	var tmp [4]byte
+	binary.BigEndian.PutUint32(tmp[:], uint32(v))
+	return append(buf, tmp[:]...)
+}
@@ -0,0 +1,66 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestXerialSnappyRoundTrip(t *testing.T) {
+	inputs := [][]byte{
+		nil,
+		[]byte("a"),
+		[]byte("the quick brown fox jumps over the lazy dog"),
+		bytes.Repeat([]byte("sarama"), 1024),
+	}
+
+	for _, input := range inputs {
+		encoded := xerialEncode(input)
+
+		if !bytes.Equal(encoded[:len(xerialHeader)], xerialHeader) {
+			t.Fatalf("xerialEncode(%q) did not start with the xerial magic header", input)
+		}
+
+		decoded, err := xerialDecode(encoded)
+		if err != nil {
+			t.Fatalf("xerialDecode failed for input %q: %v", input, err)
+		}
+		if !bytes.Equal(decoded, input) && !(len(decoded) == 0 && len(input) == 0) {
+			t.Fatalf("xerialDecode(xerialEncode(%q)) = %q, want original input back", input, decoded)
+		}
+	}
+}
+
+func TestXerialSnappyDecodeRejectsBadHeader(t *testing.T) {
+	if _, err := xerialDecode([]byte("not a snappy block")); err == nil {
+		t.Fatal("expected xerialDecode to reject data without the xerial magic header")
+	}
+}
+
+func TestCompressDecompressGZIP(t *testing.T) {
+	input := []byte("the quick brown fox jumps over the lazy dog")
+
+	compressed, err := compress(CompressionGZIP, input)
+	if err != nil {
+		t.Fatalf("compress(GZIP) failed: %v", err)
+	}
+
+	decompressed, err := decompress(CompressionGZIP, compressed)
+	if err != nil {
+		t.Fatalf("decompress(GZIP) failed: %v", err)
+	}
+	if !bytes.Equal(decompressed, input) {
+		t.Fatalf("decompress(compress(x)) = %q, want %q", decompressed, input)
+	}
+}
+
+func TestCompressNoneIsPassthrough(t *testing.T) {
+	input := []byte("unchanged")
+
+	compressed, err := compress(CompressionNone, input)
+	if err != nil {
+		t.Fatalf("compress(None) failed: %v", err)
+	}
+	if !bytes.Equal(compressed, input) {
+		t.Fatalf("compress(None, %q) = %q, want the input unchanged", input, compressed)
+	}
+}
@@ -0,0 +1,39 @@
+package protocol
+
+import "sync"
+
+// abandoned tracks correlation IDs whose caller gave up waiting (ctx was cancelled or its
+// deadline passed) before responseReceiver delivered a reply. It is guarded by its own mutex
+// rather than b.lock, since it is consulted from responseReceiver on every reply while b.lock may
+// be held for an unrelated send.
+//
+// Scope: one abandonedSet belongs to a single connection generation. Broker.Connect resets
+// correlation_id to zero on every redial, so IDs are reused across generations; Connect replaces
+// b.abandoned with a fresh, empty set for exactly that reason - never reuse one across a
+// reconnect.
+type abandonedSet struct {
+	mu  sync.Mutex
+	ids map[int32]struct{}
+}
+
+func (s *abandonedSet) add(correlationID int32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ids == nil {
+		s.ids = make(map[int32]struct{})
+	}
+	s.ids[correlationID] = struct{}{}
+}
+
+// take reports whether correlationID was abandoned, and if so clears it (this connection
+// generation never reuses a correlation ID once responseReceiver has accounted for it, so there
+// is nothing left to track it for).
+func (s *abandonedSet) take(correlationID int32) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.ids[correlationID]; !ok {
+		return false
+	}
+	delete(s.ids, correlationID)
+	return true
+}
@@ -0,0 +1,41 @@
+package protocol
+
+import (
+	"context"
+	"testing"
+)
+
+func TestAbandonedSetTakeClearsEntry(t *testing.T) {
+	var s abandonedSet
+	s.add(7)
+
+	if !s.take(7) {
+		t.Fatal("take(7) = false right after add(7), want true")
+	}
+	if s.take(7) {
+		t.Fatal("take(7) = true on a second call, want false (the entry should have been cleared)")
+	}
+}
+
+func TestAbandonedSetTakeUnknownIDReturnsFalse(t *testing.T) {
+	var s abandonedSet
+	if s.take(99) {
+		t.Fatal("take(99) = true for an ID never added, want false")
+	}
+}
+
+func TestWaitForResponseAbandonsOnContextCancellation(t *testing.T) {
+	b := &Broker{}
+	promise := &responsePromise{correlation_id: 5, packets: make(chan []byte), errors: make(chan error)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := b.waitForResponse(ctx, promise, nil); err != ctx.Err() {
+		t.Fatalf("waitForResponse returned %v, want %v", err, ctx.Err())
+	}
+
+	if !b.abandoned.take(5) {
+		t.Fatal("waitForResponse did not mark correlation ID 5 as abandoned after ctx cancellation")
+	}
+}
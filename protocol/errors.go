@@ -0,0 +1,18 @@
+package protocol
+
+import "errors"
+
+// ErrBrokerOverloaded is returned by send when MaxInFlightRequests outstanding requests are
+// already awaiting a response and the caller did not pass a context to wait on; retry later or
+// pass a context with a deadline to wait for a free slot instead.
+var ErrBrokerOverloaded = errors.New("protocol: broker has reached its in-flight request limit")
+
+// ErrRateLimited is returned by send when the broker's configured request- or byte-rate limiter
+// rejects the request; callers should back off and retry.
+var ErrRateLimited = errors.New("protocol: request rejected by broker rate limiter")
+
+// ErrConnectionLost is delivered to every outstanding responsePromise when the underlying
+// connection fails. If BrokerConfig.AutoReconnect is set, the broker redials in the background;
+// otherwise it behaves as if Close had been called and every subsequent send fails with
+// NotConnected until the caller reconnects manually.
+var ErrConnectionLost = errors.New("protocol: connection to broker was lost")
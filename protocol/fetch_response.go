@@ -0,0 +1,76 @@
+package protocol
+
+import enc "sarama/encoding"
+import "sarama/types"
+
+// FetchResponsePartition carries one partition's worth of a FetchResponse: the usual
+// high-water-mark/error bookkeeping, plus the (already-decompressed) flat stream of messages.
+type FetchResponsePartition struct {
+	Partition     int32
+	Err           types.KError
+	HighWaterMark int64
+	Messages      []*MessageBlock
+}
+
+// FetchResponse is the payload returned by Broker.Fetch. Message sets are decoded and, when a
+// partition's messages arrived wrapped in a compressed envelope, decompressed and flattened
+// transparently, so callers always see a flat list of MessageBlocks regardless of whether the
+// broker (or an upstream producer) compressed them.
+type FetchResponse struct {
+	Blocks map[string]map[int32]*FetchResponsePartition
+}
+
+func (r *FetchResponse) Decode(pd enc.PacketDecoder) error {
+	topicCount, err := pd.GetArrayLength()
+	if err != nil {
+		return err
+	}
+
+	r.Blocks = make(map[string]map[int32]*FetchResponsePartition, topicCount)
+	for i := 0; i < topicCount; i++ {
+		topic, err := pd.GetString()
+		if err != nil {
+			return err
+		}
+
+		partitionCount, err := pd.GetArrayLength()
+		if err != nil {
+			return err
+		}
+
+		partitions := make(map[int32]*FetchResponsePartition, partitionCount)
+		r.Blocks[topic] = partitions
+
+		for j := 0; j < partitionCount; j++ {
+			fp := new(FetchResponsePartition)
+
+			if fp.Partition, err = pd.GetInt32(); err != nil {
+				return err
+			}
+			if fp.Err, err = pd.GetError(); err != nil {
+				return err
+			}
+			if fp.HighWaterMark, err = pd.GetInt64(); err != nil {
+				return err
+			}
+
+			if err = pd.Push(&enc.LengthField{}); err != nil {
+				return err
+			}
+
+			set := new(MessageSet)
+			if err = set.Decode(pd); err != nil {
+				return err
+			}
+			fp.Messages = set.flatten()
+
+			if err = pd.Pop(); err != nil {
+				return err
+			}
+
+			partitions[fp.Partition] = fp
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,169 @@
+package protocol
+
+import enc "sarama/encoding"
+import "fmt"
+
+// Message is a single Kafka message as carried inside a MessageSet. When Set is non-nil the
+// message is a compressed "envelope": Value holds the compressed encoding of an inner MessageSet,
+// and Codec identifies the algorithm used to produce it.
+type Message struct {
+	Codec CompressionCodec
+	Key   []byte
+	Value []byte
+	Set   *MessageSet // decoded inner set, populated only when Codec != CompressionNone
+}
+
+func (m *Message) Encode(pe enc.PacketEncoder) error {
+	pe.Push(&enc.CRC32Field{})
+	pe.PutInt8(0) // magic byte, always 0 for the message formats this package speaks
+	pe.PutInt8(int8(m.Codec))
+
+	if err := pe.PutBytes(m.Key); err != nil {
+		return err
+	}
+
+	payload := m.Value
+	if m.Codec != CompressionNone {
+		if m.Set == nil {
+			return fmt.Errorf("protocol: compressed message missing inner Set to encode")
+		}
+		inner, err := enc.Encode(m.Set)
+		if err != nil {
+			return err
+		}
+		payload, err = compress(m.Codec, inner)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := pe.PutBytes(payload); err != nil {
+		return err
+	}
+
+	return pe.Pop()
+}
+
+func (m *Message) Decode(pd enc.PacketDecoder) (err error) {
+	if err = pd.Push(&enc.CRC32Field{}); err != nil {
+		return err
+	}
+
+	if _, err = pd.GetInt8(); err != nil { // magic byte
+		return err
+	}
+
+	attributes, err := pd.GetInt8()
+	if err != nil {
+		return err
+	}
+	m.Codec = CompressionCodec(attributes & 0x07)
+
+	if m.Key, err = pd.GetBytes(); err != nil {
+		return err
+	}
+
+	if m.Value, err = pd.GetBytes(); err != nil {
+		return err
+	}
+
+	if m.Codec != CompressionNone {
+		raw, err := decompress(m.Codec, m.Value)
+		if err != nil {
+			return err
+		}
+		m.Set = new(MessageSet)
+		if err = enc.Decode(raw, m.Set); err != nil {
+			return err
+		}
+	}
+
+	return pd.Pop()
+}
+
+// MessageBlock pairs a Message with the offset Kafka assigns it (or, for an as-yet-unacknowledged
+// produce, the offset the client used when building the set).
+type MessageBlock struct {
+	Offset  int64
+	Message *Message
+}
+
+func (b *MessageBlock) Encode(pe enc.PacketEncoder) error {
+	pe.PutInt64(b.Offset)
+	pe.Push(&enc.LengthField{})
+	if err := b.Message.Encode(pe); err != nil {
+		return err
+	}
+	return pe.Pop()
+}
+
+func (b *MessageBlock) Decode(pd enc.PacketDecoder) (err error) {
+	if b.Offset, err = pd.GetInt64(); err != nil {
+		return err
+	}
+	if err = pd.Push(&enc.LengthField{}); err != nil {
+		return err
+	}
+	b.Message = new(Message)
+	if err = b.Message.Decode(pd); err != nil {
+		return err
+	}
+	return pd.Pop()
+}
+
+// MessageSet is a length-prefixed sequence of MessageBlocks. flatten returns a new list with any
+// compressed envelope messages replaced by their inner blocks so callers always see a flat stream
+// of uncompressed blocks, with inner offsets following the outer block's offset convention (Kafka
+// assigns the outer offset to the last inner message, and flatten renumbers the inner messages
+// backwards from it; see flatten's doc comment).
+type MessageSet struct {
+	Blocks []*MessageBlock
+}
+
+func (ms *MessageSet) Encode(pe enc.PacketEncoder) error {
+	for _, block := range ms.Blocks {
+		if err := block.Encode(pe); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ms *MessageSet) Decode(pd enc.PacketDecoder) (err error) {
+	ms.Blocks = nil
+	for pd.Remaining() > 0 {
+		block := new(MessageBlock)
+		if err = block.Decode(pd); err != nil {
+			// a partial trailing message is normal at the end of a fetch response
+			// (the broker does not split messages across responses) and is not an error.
+			if err == enc.ErrInsufficientData {
+				return nil
+			}
+			return err
+		}
+		ms.Blocks = append(ms.Blocks, block)
+	}
+	return nil
+}
+
+// flatten walks ms, replacing every compressed envelope message with its decoded inner blocks so
+// that the caller sees one flat, uncompressed stream. The wrapper's Offset is the last offset
+// assigned to the batch, so inner messages (which carry their own, batch-relative offsets in the
+// 0.9-style wire format this package targets) are renumbered backwards from it.
+func (ms *MessageSet) flatten() []*MessageBlock {
+	var out []*MessageBlock
+	for _, block := range ms.Blocks {
+		if block.Message.Codec == CompressionNone || block.Message.Set == nil {
+			out = append(out, block)
+			continue
+		}
+
+		inner := block.Message.Set.flatten()
+		baseOffset := block.Offset - int64(len(inner)) + 1
+		for i, innerBlock := range inner {
+			innerBlock.Offset = baseOffset + int64(i)
+			out = append(out, innerBlock)
+		}
+	}
+	return out
+}
@@ -0,0 +1,55 @@
+package protocol
+
+import "testing"
+
+func TestMessageSetFlattenRenumbersCompressedOffsets(t *testing.T) {
+	inner := &MessageSet{
+		Blocks: []*MessageBlock{
+			{Offset: 0, Message: &Message{Value: []byte("one")}},
+			{Offset: 1, Message: &Message{Value: []byte("two")}},
+			{Offset: 2, Message: &Message{Value: []byte("three")}},
+		},
+	}
+
+	outer := &MessageSet{
+		Blocks: []*MessageBlock{
+			{
+				Offset: 10, // the outer offset Kafka assigns to the whole compressed batch
+				Message: &Message{
+					Codec: CompressionGZIP,
+					Set:   inner,
+				},
+			},
+		},
+	}
+
+	flat := outer.flatten()
+
+	wantOffsets := []int64{8, 9, 10}
+	if len(flat) != len(wantOffsets) {
+		t.Fatalf("flatten() returned %d blocks, want %d", len(flat), len(wantOffsets))
+	}
+	for i, block := range flat {
+		if block.Offset != wantOffsets[i] {
+			t.Errorf("flatten()[%d].Offset = %d, want %d", i, block.Offset, wantOffsets[i])
+		}
+		if block.Message != inner.Blocks[i].Message {
+			t.Errorf("flatten()[%d].Message = %v, want the original inner message preserved", i, block.Message)
+		}
+	}
+}
+
+func TestMessageSetFlattenLeavesUncompressedOffsetsAlone(t *testing.T) {
+	set := &MessageSet{
+		Blocks: []*MessageBlock{
+			{Offset: 0, Message: &Message{Value: []byte("one")}},
+			{Offset: 1, Message: &Message{Value: []byte("two")}},
+		},
+	}
+
+	flat := set.flatten()
+
+	if len(flat) != 2 || flat[0].Offset != 0 || flat[1].Offset != 1 {
+		t.Fatalf("flatten() of an uncompressed set changed offsets: got %+v", flat)
+	}
+}
@@ -0,0 +1,16 @@
+package protocol
+
+import "time"
+
+// Metrics lets a caller bridge Broker activity to whatever monitoring system it uses
+// (Prometheus, statsd, ...) without this package importing any of them directly. Set
+// BrokerConfig.Metrics to receive callbacks; leave it nil to disable instrumentation entirely.
+type Metrics interface {
+	// RecordRequest is called once per request/response round trip, success or failure.
+	// bytes is the size of the encoded request on the wire; latency covers send through
+	// decode. err is the error returned to the caller, if any.
+	RecordRequest(apiKey int16, bytes int, latency time.Duration, err error)
+
+	// RecordInFlight reports the current number of requests awaiting a response on this broker.
+	RecordInFlight(n int)
+}
@@ -0,0 +1,97 @@
+package protocol
+
+import enc "sarama/encoding"
+import "sarama/types"
+
+// ProduceRequest is the payload for Broker.Produce: a set of messages to append, grouped by
+// topic and partition, along with the acking/timeout semantics Kafka should apply.
+type ProduceRequest struct {
+	RequiredAcks types.RequiredAcks
+	Timeout      int32
+
+	// Compression selects the codec used to wrap each partition's MessageSet into a single
+	// compressed envelope message before it is sent. CompressionNone (the default) sends
+	// messages uncompressed exactly as before.
+	Compression CompressionCodec
+
+	msgSets map[string]map[int32]*MessageSet
+}
+
+// AddMessage appends a message to the given topic/partition's pending MessageSet, assigning it
+// the next offset in that set (the offset is renumbered by the broker on arrival, but message
+// sets must still be internally well-ordered).
+func (r *ProduceRequest) AddMessage(topic string, partition int32, msg *Message) {
+	if r.msgSets == nil {
+		r.msgSets = make(map[string]map[int32]*MessageSet)
+	}
+	if r.msgSets[topic] == nil {
+		r.msgSets[topic] = make(map[int32]*MessageSet)
+	}
+	set := r.msgSets[topic][partition]
+	if set == nil {
+		set = new(MessageSet)
+		r.msgSets[topic][partition] = set
+	}
+	set.Blocks = append(set.Blocks, &MessageBlock{Offset: int64(len(set.Blocks)), Message: msg})
+}
+
+// envelope wraps set into a single Message whose value is the compressed encoding of set, per
+// r.Compression, or returns the set's messages unchanged when Compression is CompressionNone.
+func (r *ProduceRequest) envelope(set *MessageSet) (*MessageSet, error) {
+	if r.Compression == CompressionNone {
+		return set, nil
+	}
+
+	return &MessageSet{
+		Blocks: []*MessageBlock{{
+			Offset: int64(len(set.Blocks) - 1),
+			Message: &Message{
+				Codec: r.Compression,
+				Set:   set,
+			},
+		}},
+	}, nil
+}
+
+func (r *ProduceRequest) Encode(pe enc.PacketEncoder) error {
+	pe.PutInt16(int16(r.RequiredAcks))
+	pe.PutInt32(r.Timeout)
+
+	if err := pe.PutArrayLength(len(r.msgSets)); err != nil {
+		return err
+	}
+	for topic, partitions := range r.msgSets {
+		if err := pe.PutString(topic); err != nil {
+			return err
+		}
+		if err := pe.PutArrayLength(len(partitions)); err != nil {
+			return err
+		}
+		for partition, set := range partitions {
+			pe.PutInt32(partition)
+
+			wire, err := r.envelope(set)
+			if err != nil {
+				return err
+			}
+
+			pe.Push(&enc.LengthField{})
+			if err := wire.Encode(pe); err != nil {
+				return err
+			}
+			if err := pe.Pop(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *ProduceRequest) key() int16 {
+	return 0
+}
+
+func (r *ProduceRequest) version() int16 {
+	return 0
+}
@@ -0,0 +1,25 @@
+package protocol
+
+import "golang.org/x/time/rate"
+
+// newLimiters builds the request- and byte-rate limiters described by conf, or nil for either
+// that isn't configured (a zero rate disables limiting rather than blocking everything).
+func newLimiters(conf *BrokerConfig) (requestLimiter, byteLimiter *rate.Limiter) {
+	if conf.RequestsPerSecond > 0 {
+		burst := conf.RequestBurst
+		if burst <= 0 {
+			burst = 1
+		}
+		requestLimiter = rate.NewLimiter(rate.Limit(conf.RequestsPerSecond), burst)
+	}
+
+	if conf.BytesPerSecond > 0 {
+		burst := conf.ByteBurst
+		if burst <= 0 {
+			burst = int(conf.BytesPerSecond)
+		}
+		byteLimiter = rate.NewLimiter(rate.Limit(conf.BytesPerSecond), burst)
+	}
+
+	return requestLimiter, byteLimiter
+}
@@ -0,0 +1,47 @@
+package protocol
+
+import "testing"
+
+func TestNewLimitersDisabledByDefault(t *testing.T) {
+	requestLimiter, byteLimiter := newLimiters(&BrokerConfig{})
+	if requestLimiter != nil {
+		t.Error("newLimiters returned a non-nil requestLimiter for RequestsPerSecond == 0, want disabled (nil)")
+	}
+	if byteLimiter != nil {
+		t.Error("newLimiters returned a non-nil byteLimiter for BytesPerSecond == 0, want disabled (nil)")
+	}
+}
+
+func TestNewLimitersConfigured(t *testing.T) {
+	requestLimiter, byteLimiter := newLimiters(&BrokerConfig{
+		RequestsPerSecond: 10,
+		RequestBurst:      5,
+		BytesPerSecond:    1024,
+		ByteBurst:         2048,
+	})
+	if requestLimiter == nil {
+		t.Fatal("newLimiters returned a nil requestLimiter for RequestsPerSecond > 0")
+	}
+	if requestLimiter.Burst() != 5 {
+		t.Errorf("requestLimiter.Burst() = %d, want 5", requestLimiter.Burst())
+	}
+	if byteLimiter == nil {
+		t.Fatal("newLimiters returned a nil byteLimiter for BytesPerSecond > 0")
+	}
+	if byteLimiter.Burst() != 2048 {
+		t.Errorf("byteLimiter.Burst() = %d, want 2048", byteLimiter.Burst())
+	}
+}
+
+func TestNewLimitersDefaultsBurstWhenUnset(t *testing.T) {
+	requestLimiter, byteLimiter := newLimiters(&BrokerConfig{
+		RequestsPerSecond: 10,
+		BytesPerSecond:    1024,
+	})
+	if requestLimiter.Burst() != 1 {
+		t.Errorf("requestLimiter.Burst() = %d, want 1 (default) when RequestBurst is unset", requestLimiter.Burst())
+	}
+	if byteLimiter.Burst() != 1024 {
+		t.Errorf("byteLimiter.Burst() = %d, want 1024 (BytesPerSecond) when ByteBurst is unset", byteLimiter.Burst())
+	}
+}
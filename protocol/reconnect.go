@@ -0,0 +1,111 @@
+package protocol
+
+import (
+	"math/rand"
+	"time"
+)
+
+// BrokerState is reported on Broker.StateChanged as the connection transitions between states.
+type BrokerState int
+
+const (
+	StateConnected BrokerState = iota
+	StateDisconnected
+	StateReconnecting
+)
+
+// backoff returns the delay before the (1-indexed) nth redial attempt: min*2^(n-1), capped at
+// max, with up to ±20% jitter so a fleet of brokers losing a connection at once doesn't redial in
+// lockstep.
+func backoff(n int, min, max time.Duration) time.Duration {
+	d := min << uint(n-1)
+	if d <= 0 || d > max { // overflow or past the cap
+		d = max
+	}
+
+	jitter := time.Duration(float64(d) * 0.2 * (rand.Float64()*2 - 1))
+	return d + jitter
+}
+
+// setState reports a connection state transition: if a StateChanged channel is configured, it
+// pushes the new state to it without blocking the caller (a slow or absent consumer drops states
+// rather than stalling the reconnect loop). The broker does not otherwise store the state.
+func (b *Broker) setState(state BrokerState) {
+	if b.StateChanged == nil {
+		return
+	}
+	select {
+	case b.StateChanged <- state:
+	default:
+	}
+}
+
+// loseConnection is called from responseReceiver once the connection has failed: it drains every
+// outstanding responsePromise with ErrConnectionLost, tears down the connection, and - if
+// AutoReconnect is enabled - kicks off the background redial loop.
+func (b *Broker) loseConnection() {
+	b.lock.Lock()
+	if b.conn == nil {
+		b.lock.Unlock() // Close() already tore this connection down
+		return
+	}
+	b.conn.Close()
+	b.conn = nil
+	responses := b.responses
+	b.responses = nil
+	// Captured and cleared under the same lock as b.responses above: send() takes this same lock
+	// for its own non-blocking enqueue attempt, so closing connLost only after we unlock guarantees
+	// any send() already past that attempt and waiting on the pre-swap responses/connLost pair
+	// observes the close instead of blocking on a channel we've already given up on.
+	connLost := b.connLost
+	b.connLost = nil
+	// Captured under the same lock as the teardown above: if Close() already ran for this
+	// generation, it closed and nil'd stopReconnect, and stop is nil here - in that case we must
+	// not start a new reconnectLoop at all, since the broker is being shut down deliberately.
+	stop := b.stopReconnect
+	b.lock.Unlock()
+
+	close(connLost)
+
+	b.setState(StateDisconnected)
+
+	for {
+		select {
+		case p, ok := <-responses:
+			if !ok {
+				goto drained
+			}
+			// an abandoned caller no longer reads p.errors; sending would block this goroutine forever
+			if !b.abandoned.take(p.correlation_id) {
+				p.errors <- ErrConnectionLost
+			}
+		default:
+			goto drained
+		}
+	}
+drained:
+
+	if b.conf.AutoReconnect && stop != nil {
+		go b.reconnectLoop(stop)
+	}
+}
+
+// reconnectLoop redials with exponential backoff until Connect succeeds, or stop is closed by a
+// concurrent Close() asking it to give up instead of redialing forever in the background.
+func (b *Broker) reconnectLoop(stop chan struct{}) {
+	b.setState(StateReconnecting)
+
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-time.After(backoff(attempt, b.conf.ReconnectMinInterval, b.conf.ReconnectMaxInterval)):
+		case <-stop:
+			return
+		}
+
+		err := b.Connect()
+		if err == nil || err == AlreadyConnected {
+			b.setState(StateConnected)
+			return
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package protocol
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBackoffDoublesUntilCap(t *testing.T) {
+	min := 10 * time.Millisecond
+	max := 100 * time.Millisecond
+
+	for n, want := range map[int]time.Duration{
+		1: 10 * time.Millisecond,
+		2: 20 * time.Millisecond,
+		3: 40 * time.Millisecond,
+		5: max, // min*2^4 would exceed max, so it's capped
+	} {
+		d := backoff(n, min, max)
+		lower := time.Duration(float64(want) * 0.8)
+		upper := time.Duration(float64(want) * 1.2)
+		if d < lower || d > upper {
+			t.Errorf("backoff(%d, %v, %v) = %v, want within ±20%% of %v", n, min, max, d, want)
+		}
+	}
+}
+
+func TestLoseConnectionDrainsResponsesAndSignalsConnLost(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	b := &Broker{
+		conf:      &BrokerConfig{},
+		conn:      client,
+		responses: make(chan responsePromise, 1),
+		connLost:  make(chan struct{}),
+	}
+
+	promise := responsePromise{correlation_id: 1, packets: make(chan []byte), errors: make(chan error, 1)}
+	b.responses <- promise
+
+	// loseConnection clears b.connLost before closing it, so hold on to this generation's channel.
+	connLost := b.connLost
+
+	b.loseConnection()
+
+	select {
+	case err := <-promise.errors:
+		if err != ErrConnectionLost {
+			t.Errorf("drained promise got error %v, want ErrConnectionLost", err)
+		}
+	default:
+		t.Error("loseConnection did not drain the outstanding responsePromise")
+	}
+
+	select {
+	case <-connLost:
+	default:
+		t.Error("loseConnection did not close connLost")
+	}
+
+	if b.conn != nil {
+		t.Error("loseConnection left b.conn set after tearing down the connection")
+	}
+}
+
+func TestReconnectLoopStopsWithoutRedialing(t *testing.T) {
+	b := &Broker{
+		conf: &BrokerConfig{
+			// Long enough that the test's close(stop) always wins the race against time.After.
+			ReconnectMinInterval: time.Hour,
+			ReconnectMaxInterval: time.Hour,
+		},
+	}
+
+	stop := make(chan struct{})
+	close(stop)
+
+	done := make(chan struct{})
+	go func() {
+		b.reconnectLoop(stop)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("reconnectLoop did not return promptly after stop was closed")
+	}
+}
@@ -0,0 +1,149 @@
+package protocol
+
+import enc "sarama/encoding"
+import "sarama/types"
+import "io"
+
+// saslHandshakeRequest is sent first to tell the broker which SASL mechanism the client intends
+// to use; the broker replies with the mechanisms it supports so a mismatch can be reported
+// cleanly instead of failing deep inside SaslAuthenticate.
+type saslHandshakeRequest struct {
+	mechanism string
+}
+
+func (r *saslHandshakeRequest) Encode(pe enc.PacketEncoder) error {
+	return pe.PutString(r.mechanism)
+}
+
+func (r *saslHandshakeRequest) key() int16 {
+	return 17
+}
+
+func (r *saslHandshakeRequest) version() int16 {
+	return 0
+}
+
+type saslHandshakeResponse struct {
+	err               types.KError
+	enabledMechanisms []string
+}
+
+func (r *saslHandshakeResponse) Decode(pd enc.PacketDecoder) (err error) {
+	if r.err, err = pd.GetError(); err != nil {
+		return err
+	}
+
+	r.enabledMechanisms, err = pd.GetStringArray()
+	return err
+}
+
+// saslAuthenticateRequest wraps a single opaque SASL token for the mechanism's current step.
+type saslAuthenticateRequest struct {
+	saslAuthBytes []byte
+}
+
+func (r *saslAuthenticateRequest) Encode(pe enc.PacketEncoder) error {
+	return pe.PutBytes(r.saslAuthBytes)
+}
+
+func (r *saslAuthenticateRequest) key() int16 {
+	return 36
+}
+
+func (r *saslAuthenticateRequest) version() int16 {
+	return 0
+}
+
+type saslAuthenticateResponse struct {
+	err           types.KError
+	errMessage    string
+	saslAuthBytes []byte
+}
+
+func (r *saslAuthenticateResponse) Decode(pd enc.PacketDecoder) (err error) {
+	if r.err, err = pd.GetError(); err != nil {
+		return err
+	}
+
+	if r.errMessage, err = pd.GetString(); err != nil {
+		return err
+	}
+
+	r.saslAuthBytes, err = pd.GetBytes()
+	return err
+}
+
+// authenticateSASL drives the SaslHandshake + SaslAuthenticate exchange over the already-dialled
+// (and, if configured, already TLS-wrapped) connection. It is called from Connect, under b.lock,
+// before responseReceiver is started, so it talks to b.conn directly rather than going through
+// send/sendAndReceive.
+func (b *Broker) authenticateSASL(mechanism SASLMechanism) error {
+	handshake := &saslHandshakeRequest{mechanism: mechanism.Name()}
+	handshakeResponse := new(saslHandshakeResponse)
+	if err := b.rawRequestResponse(handshake, handshakeResponse); err != nil {
+		return err
+	}
+	if handshakeResponse.err != types.ErrNoError {
+		return handshakeResponse.err
+	}
+
+	token, err := mechanism.Start()
+	if err != nil {
+		return err
+	}
+
+	for {
+		authResponse := new(saslAuthenticateResponse)
+		if err := b.rawRequestResponse(&saslAuthenticateRequest{saslAuthBytes: token}, authResponse); err != nil {
+			return err
+		}
+		if authResponse.err != types.ErrNoError {
+			return authResponse.err
+		}
+
+		if mechanism.Done() {
+			return nil
+		}
+
+		token, err = mechanism.Next(authResponse.saslAuthBytes)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// rawRequestResponse performs a single synchronous request/response round trip on b.conn without
+// going through the responsePromise machinery; it is only safe to call before responseReceiver
+// has been started (ie. during the Connect-time handshake).
+func (b *Broker) rawRequestResponse(req requestEncoder, res enc.Decoder) error {
+	fullRequest := request{b.correlation_id, "sarama-handshake", req}
+	buf, err := enc.Encode(&fullRequest)
+	if err != nil {
+		return err
+	}
+
+	if _, err = b.conn.Write(buf); err != nil {
+		return err
+	}
+	b.correlation_id++
+
+	header := make([]byte, 8)
+	if _, err = io.ReadFull(b.conn, header); err != nil {
+		return err
+	}
+
+	decodedHeader := responseHeader{}
+	if err = enc.Decode(header, &decodedHeader); err != nil {
+		return err
+	}
+	if decodedHeader.correlation_id != fullRequest.correlation_id {
+		return enc.DecodingError
+	}
+
+	payload := make([]byte, decodedHeader.length-4)
+	if _, err = io.ReadFull(b.conn, payload); err != nil {
+		return err
+	}
+
+	return enc.Decode(payload, res)
+}
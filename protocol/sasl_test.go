@@ -0,0 +1,23 @@
+package protocol
+
+import "testing"
+
+func TestSaslHandshakeRequestAPIKeyAndVersion(t *testing.T) {
+	req := &saslHandshakeRequest{mechanism: "PLAIN"}
+	if req.key() != 17 {
+		t.Errorf("saslHandshakeRequest.key() = %d, want 17 (SaslHandshake)", req.key())
+	}
+	if req.version() != 0 {
+		t.Errorf("saslHandshakeRequest.version() = %d, want 0", req.version())
+	}
+}
+
+func TestSaslAuthenticateRequestAPIKeyAndVersion(t *testing.T) {
+	req := &saslAuthenticateRequest{saslAuthBytes: []byte("token")}
+	if req.key() != 36 {
+		t.Errorf("saslAuthenticateRequest.key() = %d, want 36 (SaslAuthenticate)", req.key())
+	}
+	if req.version() != 0 {
+		t.Errorf("saslAuthenticateRequest.version() = %d, want 0", req.version())
+	}
+}
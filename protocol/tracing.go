@@ -0,0 +1,46 @@
+package protocol
+
+import (
+	"context"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+// startBrokerSpan starts a child span for a single broker request, extracting the parent span
+// (if any) from ctx. It is only called when BrokerConfig.Tracing is true; when tracing is
+// disabled, callers skip this entirely so the opentracing machinery costs nothing.
+//
+// It is started before send() writes the request, so the span covers write latency too; the
+// correlation ID isn't known until send() returns one, so callers tag it on afterward with
+// tagBrokerSpanCorrelationID rather than passing it in here.
+func (b *Broker) startBrokerSpan(ctx context.Context, operation string, apiKey int16) opentracing.Span {
+	span, _ := opentracing.StartSpanFromContext(ctx, operation)
+	span.SetTag("kafka.broker_id", b.id)
+	span.SetTag("kafka.api_key", apiKey)
+	ext.PeerAddress.Set(span, b.host)
+	return span
+}
+
+// tagBrokerSpanCorrelationID tags the correlation ID send() assigned to this request onto span. A
+// nil span (tracing disabled) is a no-op.
+func tagBrokerSpanCorrelationID(span opentracing.Span, correlationID int32) {
+	if span == nil {
+		return
+	}
+	span.SetTag("kafka.correlation_id", correlationID)
+}
+
+// finishBrokerSpan records err on span (if any) and finishes it. A nil span is a no-op so callers
+// don't need to guard every call site with a tracing-enabled check.
+func finishBrokerSpan(span opentracing.Span, err error) {
+	if span == nil {
+		return
+	}
+	if err != nil {
+		ext.Error.Set(span, true)
+		span.LogFields(log.Error(err))
+	}
+	span.Finish()
+}
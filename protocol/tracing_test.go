@@ -0,0 +1,14 @@
+package protocol
+
+import "testing"
+
+func TestFinishBrokerSpanNilSpanIsNoop(t *testing.T) {
+	// Tracing disabled means sendAndReceiveCtx passes a nil span through; finishBrokerSpan must
+	// tolerate that without panicking regardless of whether err is nil.
+	finishBrokerSpan(nil, nil)
+	finishBrokerSpan(nil, ErrConnectionLost)
+}
+
+func TestTagBrokerSpanCorrelationIDNilSpanIsNoop(t *testing.T) {
+	tagBrokerSpanCorrelationID(nil, 42)
+}